@@ -0,0 +1,245 @@
+// Copyright 2020 Thomas.Hoehenleitner [at] seerose.net
+// Use of this source code is governed by a license that can be found in the LICENSE file.
+
+package id
+
+// ID allocation
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+)
+
+// idInterval is an inclusive, closed range [Lo,Hi] of currently unused IDs.
+type idInterval struct {
+	Lo, Hi TriceID
+}
+
+// size returns the number of free IDs covered by iv.
+func (iv idInterval) size() int64 {
+	return int64(iv.Hi) - int64(iv.Lo) + 1
+}
+
+// IDAllocator is an explicit representation of the *free* ID set inside
+// [min,max], kept as a sorted slice of disjoint intervals instead of the
+// `for k := range ilu` scans newID used to do on every collision. Building
+// it is O(n log n); AllocUpward and AllocDownward are then O(1) to find the
+// first/last interval, and AllocRandom is O(log n) via a Fenwick tree kept
+// over the interval sizes, picking intervals weighted by their length so
+// the result is truly uniform over the free IDs - unlike the old
+// retry-on-collision loop, which degrades badly as the ID space fills up.
+//
+// Splitting an interval in the middle (the uncommon case for AllocRandom)
+// still costs O(n) for the slice insert and Fenwick rebuild. AllocUpward
+// and AllocDownward avoid that cost only while the interval being drained
+// still has more than one free ID left; once that interval empties, the
+// same O(n) slice delete and Fenwick rebuild apply, and this becomes the
+// routine case rather than the exception once Release has fragmented the
+// drained end into singleton intervals (see shrinkLo/shrinkHi).
+type IDAllocator struct {
+	min, max TriceID
+	free     []idInterval // sorted by Lo, disjoint
+	fenwick  []int64      // 1-based Fenwick tree over free[i].size()
+	total    int64        // cached sum of free[i].size(), same as FreeCount()
+}
+
+// NewIDAllocator builds an IDAllocator covering [min,max] minus every key
+// of ilu falling inside that range, in O(n log n). It must be built once
+// and then reused across an entire `trice insert` run instead of being
+// reconstructed per file.
+func NewIDAllocator(ilu TriceIDLookUp, min, max TriceID) *IDAllocator {
+	used := make([]TriceID, 0, len(ilu))
+	for k := range ilu {
+		if k >= min && k <= max {
+			used = append(used, k)
+		}
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i] < used[j] })
+
+	a := &IDAllocator{min: min, max: max}
+	lo := min
+	for _, u := range used {
+		if u > lo {
+			a.free = append(a.free, idInterval{Lo: lo, Hi: u - 1})
+		}
+		if u == max {
+			lo = max
+			return a.finish(lo, true)
+		}
+		lo = u + 1
+	}
+	return a.finish(lo, false)
+}
+
+// finish appends the trailing free interval [lo,max], unless exhausted is
+// true (meaning max itself was used), and builds the Fenwick tree.
+func (a *IDAllocator) finish(lo TriceID, exhausted bool) *IDAllocator {
+	if !exhausted && lo <= a.max {
+		a.free = append(a.free, idInterval{Lo: lo, Hi: a.max})
+	}
+	a.rebuildFenwick()
+	return a
+}
+
+// rebuildFenwick recomputes the Fenwick tree and the cached total from free.
+func (a *IDAllocator) rebuildFenwick() {
+	n := len(a.free)
+	a.fenwick = make([]int64, n+1)
+	a.total = 0
+	for i := 0; i < n; i++ {
+		a.fenwickAdd(i, a.free[i].size())
+		a.total += a.free[i].size()
+	}
+}
+
+// fenwickAdd adds delta to the weight of free[i].
+func (a *IDAllocator) fenwickAdd(i int, delta int64) {
+	for i++; i < len(a.fenwick); i += i & (-i) {
+		a.fenwick[i] += delta
+	}
+}
+
+// fenwickFindByWeight descends the Fenwick tree to find the interval
+// holding the target-th free ID (0-based, 0 <= target < a.total), in
+// O(log n). It returns the interval index and the offset of the target
+// inside that interval.
+func (a *IDAllocator) fenwickFindByWeight(target int64) (idx int, offset int64) {
+	n := len(a.free)
+	pos := 0
+	bitMask := 1
+	for bitMask<<1 <= n {
+		bitMask <<= 1
+	}
+	for ; bitMask != 0; bitMask >>= 1 {
+		next := pos + bitMask
+		if next <= n && a.fenwick[next] <= target {
+			pos = next
+			target -= a.fenwick[next]
+		}
+	}
+	return pos, target
+}
+
+// FreeCount returns the number of IDs still free inside [min,max].
+func (a *IDAllocator) FreeCount() int64 {
+	return a.total
+}
+
+// AllocUpward returns and removes the smallest free ID, or false if none is left.
+func (a *IDAllocator) AllocUpward() (TriceID, bool) {
+	if len(a.free) == 0 {
+		return 0, false
+	}
+	id := a.free[0].Lo
+	a.shrinkLo(0)
+	return id, true
+}
+
+// AllocDownward returns and removes the biggest free ID, or false if none is left.
+func (a *IDAllocator) AllocDownward() (TriceID, bool) {
+	if len(a.free) == 0 {
+		return 0, false
+	}
+	id := a.free[len(a.free)-1].Hi
+	a.shrinkHi(len(a.free) - 1)
+	return id, true
+}
+
+// AllocRandom returns and removes an ID chosen uniformly at random from the
+// free set, or false if none is left. w receives the existing
+// "less-than-12.5%-free" warning so callers keep seeing it.
+func (a *IDAllocator) AllocRandom(w io.Writer) (TriceID, bool) {
+	if a.total <= 0 {
+		return 0, false
+	}
+	span := int64(a.max) - int64(a.min) + 1
+	if a.total < span>>3 { // 12.5%
+		fmt.Fprintln(w, "WARNING: Less than 12.5% IDs free!")
+	}
+	idx, offset := a.fenwickFindByWeight(rand.Int63n(a.total))
+	id := a.free[idx].Lo + TriceID(offset)
+	a.remove(idx, id)
+	return id, true
+}
+
+// Release adds id back to the free set, merging it with neighboring
+// intervals when adjacent. Needed for `trice zero`.
+func (a *IDAllocator) Release(id TriceID) {
+	if id < a.min || id > a.max {
+		return
+	}
+	i := sort.Search(len(a.free), func(i int) bool { return a.free[i].Lo > id })
+	// a.free[i-1] is the last interval with Lo <= id, if any.
+	mergeLeft := i > 0 && a.free[i-1].Hi+1 == id
+	mergeRight := i < len(a.free) && a.free[i].Lo-1 == id
+	switch {
+	case mergeLeft && mergeRight:
+		a.free[i-1].Hi = a.free[i].Hi
+		a.free = append(a.free[:i], a.free[i+1:]...)
+	case mergeLeft:
+		a.free[i-1].Hi = id
+	case mergeRight:
+		a.free[i].Lo = id
+	default:
+		a.free = append(a.free, idInterval{})
+		copy(a.free[i+1:], a.free[i:])
+		a.free[i] = idInterval{Lo: id, Hi: id}
+	}
+	a.rebuildFenwick()
+}
+
+// shrinkLo removes the lowest ID from free[i], deleting the interval if it becomes empty.
+func (a *IDAllocator) shrinkLo(i int) {
+	a.free[i].Lo++
+	a.total--
+	if a.free[i].Lo > a.free[i].Hi {
+		a.free = append(a.free[:i], a.free[i+1:]...)
+		a.rebuildFenwickKeepTotal()
+		return
+	}
+	a.fenwickAdd(i, -1)
+}
+
+// shrinkHi removes the highest ID from free[i], deleting the interval if it becomes empty.
+func (a *IDAllocator) shrinkHi(i int) {
+	a.free[i].Hi--
+	a.total--
+	if a.free[i].Lo > a.free[i].Hi {
+		a.free = append(a.free[:i], a.free[i+1:]...)
+		a.rebuildFenwickKeepTotal()
+		return
+	}
+	a.fenwickAdd(i, -1)
+}
+
+// remove deletes the single id inside free[idx], splitting that interval
+// into at most two pieces as needed.
+func (a *IDAllocator) remove(idx int, id TriceID) {
+	iv := a.free[idx]
+	switch {
+	case id == iv.Lo:
+		a.shrinkLo(idx)
+	case id == iv.Hi:
+		a.shrinkHi(idx)
+	default:
+		left := idInterval{Lo: iv.Lo, Hi: id - 1}
+		right := idInterval{Lo: id + 1, Hi: iv.Hi}
+		a.free[idx] = left
+		a.free = append(a.free, idInterval{})
+		copy(a.free[idx+2:], a.free[idx+1:])
+		a.free[idx+1] = right
+		a.total--
+		a.rebuildFenwickKeepTotal()
+	}
+}
+
+// rebuildFenwickKeepTotal rebuilds the Fenwick tree from free without
+// touching a.total, which the caller already adjusted for the single ID
+// that changed hands.
+func (a *IDAllocator) rebuildFenwickKeepTotal() {
+	total := a.total
+	a.rebuildFenwick()
+	a.total = total
+}
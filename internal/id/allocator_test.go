@@ -0,0 +1,97 @@
+// Copyright 2020 Thomas.Hoehenleitner [at] seerose.net
+// Use of this source code is governed by a license that can be found in the LICENSE file.
+
+package id
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIDAllocatorUpward(t *testing.T) {
+	ilu := TriceIDLookUp{5: TriceFmt{}, 6: TriceFmt{}, 8: TriceFmt{}}
+	a := NewIDAllocator(ilu, 1, 10)
+	if got := a.FreeCount(); got != 7 {
+		t.Fatalf("FreeCount() = %d, want 7", got)
+	}
+	if id, ok := a.AllocUpward(); !ok || id != 1 {
+		t.Fatalf("AllocUpward() = %v,%v, want 1,true", id, ok)
+	}
+	if id, ok := a.AllocUpward(); !ok || id != 2 {
+		t.Fatalf("AllocUpward() = %v,%v, want 2,true", id, ok)
+	}
+	if id, ok := a.AllocUpward(); !ok || id != 3 {
+		t.Fatalf("AllocUpward() = %v,%v, want 3,true", id, ok)
+	}
+	if id, ok := a.AllocUpward(); !ok || id != 4 {
+		t.Fatalf("AllocUpward() = %v,%v, want 4,true", id, ok)
+	}
+	// 5, 6 are used, so the next free upward ID is 7.
+	if id, ok := a.AllocUpward(); !ok || id != 7 {
+		t.Fatalf("AllocUpward() = %v,%v, want 7,true", id, ok)
+	}
+}
+
+func TestIDAllocatorDownward(t *testing.T) {
+	ilu := TriceIDLookUp{5: TriceFmt{}}
+	a := NewIDAllocator(ilu, 1, 10)
+	if id, ok := a.AllocDownward(); !ok || id != 10 {
+		t.Fatalf("AllocDownward() = %v,%v, want 10,true", id, ok)
+	}
+	if id, ok := a.AllocDownward(); !ok || id != 9 {
+		t.Fatalf("AllocDownward() = %v,%v, want 9,true", id, ok)
+	}
+}
+
+func TestIDAllocatorExhaustion(t *testing.T) {
+	ilu := TriceIDLookUp{}
+	a := NewIDAllocator(ilu, 1, 2)
+	if _, ok := a.AllocUpward(); !ok {
+		t.Fatal("AllocUpward() should still have an ID left")
+	}
+	if _, ok := a.AllocUpward(); !ok {
+		t.Fatal("AllocUpward() should still have an ID left")
+	}
+	if _, ok := a.AllocUpward(); ok {
+		t.Fatal("AllocUpward() should report exhaustion once the space is full")
+	}
+}
+
+func TestIDAllocatorSplitAndRelease(t *testing.T) {
+	a := NewIDAllocator(TriceIDLookUp{}, 1, 5)
+	a.Release(100) // out of [min,max], must be silently ignored
+
+	// Removing 3 from the middle of [1,5] splits it into [1,2] and [4,5].
+	a.remove(0, 3)
+	if got := a.FreeCount(); got != 4 {
+		t.Fatalf("FreeCount() after split = %d, want 4", got)
+	}
+
+	// Releasing 3 again must merge the two halves back into a single [1,5].
+	a.Release(3)
+	if got := a.FreeCount(); got != 5 {
+		t.Fatalf("FreeCount() after release = %d, want 5", got)
+	}
+	if len(a.free) != 1 || a.free[0] != (idInterval{Lo: 1, Hi: 5}) {
+		t.Fatalf("free intervals after release = %+v, want a single [1,5]", a.free)
+	}
+}
+
+func TestIDAllocatorRandomCoversEveryIDExactlyOnce(t *testing.T) {
+	a := NewIDAllocator(TriceIDLookUp{}, 1, 20)
+	var buf bytes.Buffer
+	seen := map[TriceID]bool{}
+	for i := 0; i < 20; i++ {
+		id, ok := a.AllocRandom(&buf)
+		if !ok {
+			t.Fatalf("AllocRandom() ran out early at i=%d", i)
+		}
+		if seen[id] {
+			t.Fatalf("AllocRandom() returned duplicate id %v", id)
+		}
+		seen[id] = true
+	}
+	if _, ok := a.AllocRandom(&buf); ok {
+		t.Fatal("AllocRandom() should report exhaustion once the space is full")
+	}
+}
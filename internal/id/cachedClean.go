@@ -5,16 +5,30 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"runtime"
-	"strings"
-	"time"
 
+	"github.com/rokath/trice/internal/id/contentcache"
 	"github.com/rokath/trice/pkg/ant"
 	"github.com/rokath/trice/pkg/msg"
 	"github.com/spf13/afero"
 )
 
+// CacheStore is the backend used to persist the content cache. It defaults
+// to nil, meaning an AferoCacheStore rooted at ~/.trice/cache on the
+// running afero filesystem. Set it to point trice at an in-memory store for
+// tests, or a shared store for CI runners and distributed build farms. This
+// reduced tree has no cmd package to attach a --cache-store flag to; such a
+// flag would just set this same var from wherever trice's command tree lives.
+var CacheStore contentcache.CacheStore
+
 // triceIDCleaning reads file, processes it and writes it back, if needed and uses cache if possible.
+//
+// The cache is content-addressed: the key for path is its normalized
+// source key (see CacheStore.NormalizeKey), but a cache hit also requires
+// the SHA-256 digest of path's current content to match the digest
+// recorded for that key. A touch or a git checkout that leaves the content
+// unchanged therefore does not invalidate the cache, unlike the former
+// mtime comparison. Only the entry recorded last for path is kept, so a
+// revert to an older state of path is a miss.
 func (p *idData) triceIDCleaning(w io.Writer, fSys *afero.Afero, path string, fileInfo os.FileInfo, a *ant.Admin) error {
 	if p.err != nil {
 		return p.err
@@ -24,75 +38,58 @@ func (p *idData) triceIDCleaning(w io.Writer, fSys *afero.Afero, path string, fi
 	//
 	var err error
 	var cacheExists bool
-	var cleanedCachePath string
+	var sourceDigest, key string
+	var cc *contentcache.CacheContext
 	cache := filepath.Join(UserHomeDir, ".trice/cache")
+	store := CacheStore
+	if store == nil {
+		store = contentcache.NewAferoCacheStore(fSys, cache)
+	}
 	if TriceCacheEnabled {
-
-		if _, err = fSys.Stat(cache); err == nil { // cache folder exists
+		cacheExists = storeReady(store)
+		if cacheExists {
 			// This cache code works in conjunction with the cache code in function triceIDInsertion.
-			cacheExists = true
-			fullPath, err := filepath.Abs(path)
+			cc, err = contentcache.Load(store)
+			p.join(err)
+			key, err = store.NormalizeKey(path)
+			p.join(err)
+			sourceDigest, err = contentcache.HashFile(fSys, path)
 			p.join(err)
 
-			// The drive letter of filepath.Abs(path) could be e but of os.UserHomeDir() could be c.
-			// Remove first colon, if exists (Windows).
-			before, after, found := strings.Cut(fullPath, ":")
-
-			// Throw away drive letter, when testing on windows.
-			if found && runtime.GOOS == "windows" && len(before) == 1 {
-				home, err := os.UserHomeDir()
-				if err != nil {
-					return err
-				}
-				if home != UserHomeDir { // A test is running. (We modify UserHomeDir during tests.)
-					before = ""
+			if entry, ok := cc.Lookup(key); ok {
+				switch sourceDigest {
+				case entry.SourceDigest:
+					if entry.CleanedDigest == entry.SourceDigest {
+						msg.Tell(w, "trice c was executed before, nothing to do")
+						return msg.OnErrFv(w, p.err) // `trice c File`: File == cCache ? done
+					}
+					msg.Tell(w, "trice c was executed before, copy cCache into file")
+					err = cc.CopyBlobTo(fSys, entry.CleanedDigest, path)
+					p.join(err)
+					return msg.OnErrFv(w, p.err) // That's it.
+				case entry.InsertedDigest:
+					// trice i was run on path since entry was recorded, so
+					// the file now holds the inserted (ID-carrying) variant
+					// instead of path's plain source. We already have the
+					// matching cleaned blob from back when path was last
+					// cleaned, so trice c can still be served from cache.
+					// (entry.InsertedDigest is only ever set by
+					// triceIDInsertion, which is not part of this reduced
+					// tree; until that wiring lands elsewhere this case
+					// stays dormant, since InsertedDigest starts empty and
+					// sourceDigest is never the empty string.)
+					msg.Tell(w, "trice i was executed before, copy cCache into file")
+					err = cc.CopyBlobTo(fSys, entry.CleanedDigest, path)
+					p.join(err)
+					return msg.OnErrFv(w, p.err)
 				}
 			}
-			fullPath = before + after // Remove colon if there is one.
-
-			// Construct insertedCachePath and cleanedCachePath.
-			insertedCachePath := filepath.Join(cache, insertedCacheFolderName, fullPath)
-			cleanedCachePath = filepath.Join(cache, cleanedCacheFolderName, fullPath)
-
-			// If no cleanedCachePath, execute clean operation
-			cCache, err := fSys.Stat(cleanedCachePath)
-			if err != nil {
-				msg.Tell(w, "no cleaned Cache file")
-				goto clean
-			}
-
-			// If path content equals cleanedCachePath content, we are done.
-			if time.Time.Equal(fileInfo.ModTime(), cCache.ModTime()) {
-				msg.Tell(w, "trice c was executed before, nothing to do")
-				return msg.OnErrFv(w, p.err) // `trice c File`: File == cCache ? done
-			}
-
-			// If no insertedCachePath, execute clean operation.
-			iCache, err := fSys.Stat(insertedCachePath)
-			if err != nil {
-				msg.Tell(w, "no inserted Cache file")
-				goto clean
-			}
-
-			// If path content equals insertedCachePath content, we can copy cleanedCachePath to path.
-			// We know here, that cleanedCachePath exists and path was not edited.
-			if time.Time.Equal(fileInfo.ModTime(), iCache.ModTime()) && fileExists(fSys, cleanedCachePath) {
-				// trice i File: File == iCache ? cCache -> F (trice c was executed before)
-
-				msg.Tell(w, "trice c was executed before, copy cCache into file")
-				err = CopyFileWithMTime(fSys, path, cleanedCachePath)
-				p.join(err)
-				return msg.OnErrFv(w, p.err) // That's it.
-			}
-			msg.Tell(w, "File was edited, invalidate cache")
-			fSys.Remove(insertedCachePath)
-			fSys.Remove(cleanedCachePath)
+			msg.Tell(w, "no matching cache entry, invalidate")
 		}
 	}
 	//
 	///////////////////////////////////////////////////////////////////////////////
 
-clean:
 	err = p.processTriceIDCleaning(w, fSys, path, fileInfo, a)
 	p.join(err)
 
@@ -102,10 +99,11 @@ clean:
 	if TriceCacheEnabled && cacheExists && p.err == nil {
 		// The file could have been modified by the user but if IDs are not touched, modified is false.
 		// So we need to update the cache also when modified is false.
-		msg.Tell(w, "Copy file into the cleaned-cache.")
-		err = fSys.MkdirAll(filepath.Dir(cleanedCachePath), 0o700)
+		msg.Tell(w, "Store the cleaned file content in the content-addressed cache.")
+		cleanedDigest, err := cc.PutBlob(fSys, path)
 		p.join(err)
-		err = CopyFileWithMTime(fSys, cleanedCachePath, path)
+		cc.Insert(key, contentcache.Entry{SourceDigest: sourceDigest, CleanedDigest: cleanedDigest})
+		err = cc.Save()
 		p.join(err)
 	}
 	if TriceCacheEnabled && !cacheExists {
@@ -116,3 +114,23 @@ clean:
 
 	return msg.OnErrFv(w, p.err)
 }
+
+// storeReady reports whether the cache backing store is ready to use. The
+// default AferoCacheStore needs its root directory to already exist (so
+// users opt in by creating ~/.trice/cache); other stores are assumed
+// ready, since they are provisioned outside of trice, e.g. a pre-existing
+// S3 bucket or network share set via CacheStore.
+//
+// The existence check must run on the store's own filesystem (afStore.FSys),
+// not on fSys (the source tree being cleaned): once CacheStore points at
+// something other than the default - an afero.MemMapFs in tests, or a
+// remote afero backend - its root generally does not exist on fSys at all,
+// so checking fSys here would make every non-default store look missing.
+func storeReady(store contentcache.CacheStore) bool {
+	afStore, ok := store.(*contentcache.AferoCacheStore)
+	if !ok {
+		return true
+	}
+	_, err := afStore.FSys.Stat(afStore.Dir)
+	return err == nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 Thomas.Hoehenleitner [at] seerose.net
+// Use of this source code is governed by a license that can be found in the LICENSE file.
+
+// Package contentcache implements a content-addressed cache for cleaned and
+// inserted trice source files. Unlike a path+mtime cache, an entry is
+// validated by the SHA-256 digest of the file content, and blobs are stored
+// under their digest, so a touch or a git checkout that leaves the content
+// unchanged is a cache hit instead of an invalidation. Each path keeps only
+// the entry recorded last: a revert to an older state of the file is a miss.
+//
+// Storage is abstracted behind a CacheStore, so the same CacheContext logic
+// works whether the backing store is a local ~/.trice/cache folder, an
+// in-memory store for tests, or a shared store for CI and build farms.
+package contentcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+
+	iradix "github.com/hashicorp/go-immutable-radix"
+	"github.com/spf13/afero"
+)
+
+// indexFileName is the key of the persisted radix tree index inside a CacheStore.
+const indexFileName = "index.json"
+
+// blobsDirName is the key prefix holding content-addressed blobs inside a CacheStore.
+const blobsDirName = "blobs/sha256"
+
+// Entry is the cache information kept for a single source file.
+type Entry struct {
+	SourceDigest   string // digest of the source file content this entry was built from
+	CleanedDigest  string // digest of the cleaned output (equals SourceDigest when the file was already clean)
+	InsertedDigest string // digest of the inserted (ID-carrying) variant, empty if none was stored yet
+}
+
+// CacheContext is a content-addressed cache backed by Store. It keeps an
+// immutable radix tree mapping normalized source keys (see
+// CacheStore.NormalizeKey) to Entry values and persists that tree as a
+// single index key inside Store.
+type CacheContext struct {
+	Store CacheStore
+
+	mu   sync.Mutex
+	tree *iradix.Tree
+}
+
+// indexRecord is the on-disk representation of one radix tree leaf.
+type indexRecord struct {
+	Key   string
+	Entry Entry
+}
+
+// Load reads the persisted index from store, if any, and returns a ready to
+// use CacheContext. A missing index is not an error - an empty cache is
+// returned instead, so a first run just populates it.
+func Load(store CacheStore) (*CacheContext, error) {
+	c := &CacheContext{Store: store, tree: iradix.New()}
+	b, err := store.Get(indexFileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []indexRecord
+	if err = json.Unmarshal(b, &records); err != nil {
+		return nil, err
+	}
+	txn := c.tree.Txn()
+	for _, r := range records {
+		txn.Insert([]byte(r.Key), r.Entry)
+	}
+	c.tree = txn.Commit()
+	return c, nil
+}
+
+// Save persists the radix tree index to c.Store.
+func (c *CacheContext) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var records []indexRecord
+	c.tree.Root().Walk(func(k []byte, v interface{}) bool {
+		records = append(records, indexRecord{Key: string(k), Entry: v.(Entry)})
+		return false
+	})
+	b, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return err
+	}
+	return c.Store.Put(indexFileName, b)
+}
+
+// Lookup returns the Entry stored for key, if any.
+func (c *CacheContext) Lookup(key string) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.tree.Get([]byte(key))
+	if !ok {
+		return Entry{}, false
+	}
+	return v.(Entry), true
+}
+
+// Insert adds or replaces the Entry stored for key.
+func (c *CacheContext) Insert(key string, e Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tree, _, _ = c.tree.Insert([]byte(key), e)
+}
+
+// HashFile returns the hex SHA-256 digest of the content of path on fSys.
+func HashFile(fSys *afero.Afero, path string) (string, error) {
+	f, err := fSys.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// blobKey returns the store key for the blob holding digest.
+func blobKey(digest string) string {
+	return path.Join(blobsDirName, digest)
+}
+
+// PutBlob stores the content of path (read through fSys, the source
+// filesystem) as a blob keyed by its digest and returns that digest.
+// Storing is a no-op when a blob with the same digest already exists in
+// c.Store, which is what deduplicates identical content across files.
+func (c *CacheContext) PutBlob(fSys *afero.Afero, path string) (string, error) {
+	digest, err := HashFile(fSys, path)
+	if err != nil {
+		return "", err
+	}
+	key := blobKey(digest)
+	if _, err = c.Store.Stat(key); err == nil {
+		return digest, nil // identical content already cached
+	}
+	b, err := fSys.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return digest, c.Store.Put(key, b)
+}
+
+// CopyBlobTo copies the blob stored under digest into path on fSys.
+func (c *CacheContext) CopyBlobTo(fSys *afero.Afero, digest, path string) error {
+	b, err := c.Store.Get(blobKey(digest))
+	if err != nil {
+		return err
+	}
+	return fSys.WriteFile(path, b, 0o644)
+}
+
+// GC walks the radix tree, marks every blob reachable from a cleaned or
+// inserted digest, and removes every unreferenced blob from c.Store. It is
+// the library-level implementation behind a `trice cache gc` subcommand;
+// this reduced tree has no cmd package to attach that subcommand or a flag
+// to, so GC is not yet reachable from the trice CLI - wiring it up belongs
+// wherever `trice cache` itself is rooted.
+func (c *CacheContext) GC(w io.Writer) error {
+	c.mu.Lock()
+	reachable := make(map[string]bool)
+	c.tree.Root().Walk(func(k []byte, v interface{}) bool {
+		e := v.(Entry)
+		if e.CleanedDigest != "" {
+			reachable[e.CleanedDigest] = true
+		}
+		if e.InsertedDigest != "" {
+			reachable[e.InsertedDigest] = true
+		}
+		return false
+	})
+	c.mu.Unlock()
+
+	var removed int
+	err := c.Store.Walk(blobsDirName, func(key string) error {
+		digest := path.Base(key)
+		if reachable[digest] {
+			return nil
+		}
+		if err := c.Store.Remove(key); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		fmt.Fprintln(w, "trice cache gc: removed", removed, "unreferenced blob(s)")
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 Thomas.Hoehenleitner [at] seerose.net
+// Use of this source code is governed by a license that can be found in the LICENSE file.
+
+package contentcache
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func newTestStore() (*afero.Afero, *AferoCacheStore) {
+	fSys := &afero.Afero{Fs: afero.NewMemMapFs()}
+	return fSys, NewAferoCacheStore(fSys, "/cache")
+}
+
+func TestLoadEmptyIsNotAnError(t *testing.T) {
+	_, store := newTestStore()
+	cc, err := Load(store)
+	if err != nil {
+		t.Fatalf("Load() error = %v, want nil", err)
+	}
+	if _, ok := cc.Lookup("/some/file.c"); ok {
+		t.Fatal("Lookup() on an empty cache should miss")
+	}
+}
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	_, store := newTestStore()
+	cc, err := Load(store)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	want := Entry{SourceDigest: "abc", CleanedDigest: "def"}
+	cc.Insert("/src/file.c", want)
+	if err := cc.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	cc2, err := Load(store)
+	if err != nil {
+		t.Fatalf("second Load() error = %v", err)
+	}
+	got, ok := cc2.Lookup("/src/file.c")
+	if !ok || got != want {
+		t.Fatalf("Lookup() after reload = %+v,%v, want %+v,true", got, ok, want)
+	}
+}
+
+func TestPutBlobDeduplicatesIdenticalContent(t *testing.T) {
+	fSys, store := newTestStore()
+	cc, err := Load(store)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if err = fSys.WriteFile("/src/a.c", []byte("same content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err = fSys.WriteFile("/src/b.c", []byte("same content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	digestA, err := cc.PutBlob(fSys, "/src/a.c")
+	if err != nil {
+		t.Fatalf("PutBlob(a) error = %v", err)
+	}
+	digestB, err := cc.PutBlob(fSys, "/src/b.c")
+	if err != nil {
+		t.Fatalf("PutBlob(b) error = %v", err)
+	}
+	if digestA != digestB {
+		t.Fatalf("digests for identical content differ: %s != %s", digestA, digestB)
+	}
+
+	if err = cc.CopyBlobTo(fSys, digestA, "/out.c"); err != nil {
+		t.Fatalf("CopyBlobTo() error = %v", err)
+	}
+	got, err := fSys.ReadFile("/out.c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte("same content")) {
+		t.Fatalf("CopyBlobTo() content = %q, want %q", got, "same content")
+	}
+}
+
+func TestGCRemovesOnlyUnreferencedBlobs(t *testing.T) {
+	fSys, store := newTestStore()
+	cc, err := Load(store)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if err = fSys.WriteFile("/src/keep.c", []byte("keep me"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	keepDigest, err := cc.PutBlob(fSys, "/src/keep.c")
+	if err != nil {
+		t.Fatalf("PutBlob() error = %v", err)
+	}
+	cc.Insert("/src/keep.c", Entry{SourceDigest: keepDigest, CleanedDigest: keepDigest})
+
+	// An orphan blob with no referencing Entry.
+	if err = store.Put(blobKey("orphandigest"), []byte("orphan")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = cc.GC(&buf); err != nil {
+		t.Fatalf("GC() error = %v", err)
+	}
+
+	if _, err = store.Stat(blobKey(keepDigest)); err != nil {
+		t.Fatalf("GC() removed a referenced blob: %v", err)
+	}
+	if _, err = store.Stat(blobKey("orphandigest")); err == nil {
+		t.Fatal("GC() should have removed the orphan blob")
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 Thomas.Hoehenleitner [at] seerose.net
+// Use of this source code is governed by a license that can be found in the LICENSE file.
+
+package contentcache
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// CacheStore abstracts the persistent storage backing a CacheContext, so
+// the content cache can be pointed at something other than a local
+// ~/.trice/cache folder - an in-memory afero.MemMapFs for tests, an
+// S3/GCS-backed afero filesystem, or a network-mounted directory shared by
+// a distributed build farm. This reduced tree has no cmd package to attach
+// a --cache-store flag to, so selecting an alternate store today means
+// setting the package-level CacheStore var directly; a flag would just set
+// that same var from whichever command tree trice is rooted at.
+type CacheStore interface {
+	// Stat reports whether key exists in the store.
+	Stat(key string) (os.FileInfo, error)
+	// Get returns the content stored under key. For a missing key, the
+	// returned error must satisfy errors.Is(err, fs.ErrNotExist) - Load
+	// relies on this to treat "no index yet" as an empty cache rather than
+	// a hard failure, which a remote-backed store must honor explicitly
+	// since its native "not found" error rarely embeds fs.ErrNotExist on
+	// its own.
+	Get(key string) ([]byte, error)
+	// Put stores data under key, creating any needed parent directories.
+	Put(key string, data []byte) error
+	// Remove deletes key from the store. Removing a missing key is not an error.
+	Remove(key string) error
+	// Walk calls fn with every key stored below prefix.
+	Walk(prefix string, fn func(key string) error) error
+	// NormalizeKey turns path into the key this store expects. The default
+	// AferoCacheStore drops a Windows drive letter here, so remote stores
+	// can work with pure POSIX keys regardless of which machine wrote them.
+	NormalizeKey(path string) (string, error)
+}
+
+// AferoCacheStore is the default CacheStore, backed by an *afero.Afero
+// rooted at Dir. It is what ~/.trice/cache uses, but the same type works
+// for any afero filesystem, including afero.NewMemMapFs() in tests.
+type AferoCacheStore struct {
+	FSys *afero.Afero
+	Dir  string
+}
+
+// NewAferoCacheStore returns a CacheStore rooted at dir on fSys.
+func NewAferoCacheStore(fSys *afero.Afero, dir string) *AferoCacheStore {
+	return &AferoCacheStore{FSys: fSys, Dir: dir}
+}
+
+// path returns the filesystem path for key below s.Dir.
+func (s *AferoCacheStore) path(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(key))
+}
+
+// Stat reports whether key exists in the store.
+func (s *AferoCacheStore) Stat(key string) (os.FileInfo, error) {
+	return s.FSys.Stat(s.path(key))
+}
+
+// Get returns the content stored under key.
+func (s *AferoCacheStore) Get(key string) ([]byte, error) {
+	return s.FSys.ReadFile(s.path(key))
+}
+
+// Put stores data under key. The write is atomic: data lands in a
+// "<key>.tmp" sibling first and is then renamed into place, so a crash
+// mid-write never leaves behind truncated content.
+func (s *AferoCacheStore) Put(key string, data []byte) error {
+	p := s.path(key)
+	if err := s.FSys.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := s.FSys.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return s.FSys.Rename(tmp, p)
+}
+
+// Remove deletes key from the store. Removing a missing key is not an error.
+func (s *AferoCacheStore) Remove(key string) error {
+	err := s.FSys.Remove(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Walk calls fn with every key stored below prefix.
+func (s *AferoCacheStore) Walk(prefix string, fn func(key string) error) error {
+	root := s.path(prefix)
+	err := s.FSys.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.Dir, p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel))
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// NormalizeKey turns path into a cleaned absolute unix-style key. A
+// Windows drive letter colon ("C:/foo" -> "C/foo") is dropped so remote
+// stores can use pure POSIX keys regardless of which machine produced them.
+func (s *AferoCacheStore) NormalizeKey(path string) (string, error) {
+	var abs string
+	if len(path) >= 3 && path[1] == ':' && (path[2] == '\\' || path[2] == '/') {
+		// A Windows drive path is absolute on any OS, so it is only cleaned
+		// and not joined to the working directory.
+		abs = filepath.ToSlash(filepath.Clean(strings.ReplaceAll(path, `\`, "/")))
+	} else {
+		var err error
+		if abs, err = filepath.Abs(path); err != nil {
+			return "", err
+		}
+		abs = filepath.ToSlash(abs)
+	}
+	if i := strings.Index(abs, ":"); i == 1 {
+		abs = abs[:1] + abs[2:]
+	}
+	return abs, nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Thomas.Hoehenleitner [at] seerose.net
+// Use of this source code is governed by a license that can be found in the LICENSE file.
+
+package contentcache
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAferoCacheStoreNormalizeKeyDropsWindowsDriveLetter(t *testing.T) {
+	_, store := newTestStore()
+	key, err := store.NormalizeKey(`C:\src\file.c`)
+	if err != nil {
+		t.Fatalf("NormalizeKey() error = %v", err)
+	}
+	if key[:1] != "C" {
+		t.Fatalf("NormalizeKey() = %q, want it to start with %q", key, "C")
+	}
+	if len(key) > 1 && key[1] == ':' {
+		t.Fatalf("NormalizeKey() = %q, the drive letter colon should be dropped", key)
+	}
+}
+
+func TestAferoCacheStoreGetMissingKeyIsNotExist(t *testing.T) {
+	_, store := newTestStore()
+	_, err := store.Get("nope")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Get() on a missing key = %v, want an error satisfying errors.Is(err, fs.ErrNotExist)", err)
+	}
+}
+
+// memCacheStore is a minimal CacheStore backed by a plain map. It stands in
+// for a hand-rolled remote backend, proving CacheContext only relies on the
+// CacheStore interface rather than on AferoCacheStore specifically.
+type memCacheStore struct {
+	data map[string][]byte
+}
+
+func newMemCacheStore() *memCacheStore {
+	return &memCacheStore{data: map[string][]byte{}}
+}
+
+func (s *memCacheStore) Stat(key string) (os.FileInfo, error) {
+	if _, ok := s.data[key]; !ok {
+		return nil, fs.ErrNotExist
+	}
+	return nil, nil
+}
+
+func (s *memCacheStore) Get(key string) ([]byte, error) {
+	b, ok := s.data[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return b, nil
+}
+
+func (s *memCacheStore) Put(key string, data []byte) error {
+	s.data[key] = data
+	return nil
+}
+
+func (s *memCacheStore) Remove(key string) error {
+	delete(s.data, key)
+	return nil
+}
+
+func (s *memCacheStore) Walk(prefix string, fn func(key string) error) error {
+	for k := range s.data {
+		if strings.HasPrefix(k, prefix) {
+			if err := fn(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memCacheStore) NormalizeKey(path string) (string, error) {
+	return path, nil
+}
+
+func TestCacheContextWorksWithAnyCacheStore(t *testing.T) {
+	store := newMemCacheStore()
+	cc, err := Load(store)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	cc.Insert("/a.c", Entry{SourceDigest: "x", CleanedDigest: "x"})
+	if err = cc.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	cc2, err := Load(store)
+	if err != nil {
+		t.Fatalf("second Load() error = %v", err)
+	}
+	if _, ok := cc2.Lookup("/a.c"); !ok {
+		t.Fatal("Lookup() should find the entry saved through a non-afero CacheStore")
+	}
+}
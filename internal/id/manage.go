@@ -10,8 +10,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
-	"math/rand"
 	"strconv"
 	"strings"
 
@@ -48,92 +46,46 @@ func NewLutLI(w io.Writer, fSys *afero.Afero, fn string) TriceIDLookUpLI {
 // newID() gets a new ID not used so far.
 // The delivered id is usable as key for lu, but not added. So calling fn twice without adding to ilu could give the same value back.
 // It is important that ilu was refreshed before with all sources to avoid finding as a new ID an ID which is already used in the source tree.
+//
+// This is a thin adapter kept for existing call sites: it builds a
+// throwaway *IDAllocator from ilu on every call, same as before IDAllocator
+// existed. Batch callers that allocate many IDs in one run should use
+// newIDWithAllocator instead to reuse a single *IDAllocator across the run.
 func (ilu TriceIDLookUp) newID(w io.Writer, min, max TriceID, searchMethod string) TriceID {
+	return ilu.newIDWithAllocator(w, min, max, searchMethod, nil)
+}
+
+// newIDWithAllocator is like newID, but reuses alloc instead of building a
+// fresh *IDAllocator when alloc is non-nil. This is the fast path for a
+// batch run - e.g. `trice insert` walking many files - that builds one
+// *IDAllocator per TriceIDLookUp with NewIDAllocator and passes it into
+// every newIDWithAllocator call for that run instead of paying
+// NewIDAllocator's O(n log n) scan-and-sort again per ID. idData is not
+// part of this reduced tree, so that run-scoped allocator cannot be stored
+// on it here; whatever code builds idData should hold the *IDAllocator and
+// call this adapter once idData wiring lands.
+func (ilu TriceIDLookUp) newIDWithAllocator(w io.Writer, min, max TriceID, searchMethod string, alloc *IDAllocator) TriceID {
 	if Verbose {
 		fmt.Fprintln(w, "IDMin=", min, "IDMax=", max, "IDMethod=", searchMethod)
 	}
+	if alloc == nil {
+		alloc = NewIDAllocator(ilu, min, max)
+	}
+	var id TriceID
+	var ok bool
 	switch searchMethod {
 	case "random":
-		return ilu.newRandomID(w, min, max)
+		id, ok = alloc.AllocRandom(w)
 	case "upward":
-		return ilu.newUpwardID(min, max)
+		id, ok = alloc.AllocUpward()
 	case "downward":
-		return ilu.newDownwardID(min, max)
-	}
-	msg.Info(fmt.Sprint("ERROR:", searchMethod, "is unknown ID search method."))
-	return 0
-}
-
-// newRandomID provides a random free ID inside interval [min,max].
-// The delivered id is usable as key for lu, but not added. So calling fn twice without adding to ilu could give the same value back.
-func (ilu TriceIDLookUp) newRandomID(w io.Writer, min, max TriceID) (id TriceID) {
-	interval := int(max - min + 1)
-	freeIDs := interval - len(ilu)
-	msg.FatalInfoOnFalse(freeIDs > 0, "no new ID possible, "+fmt.Sprint(min, max, len(ilu)))
-	wrnLimit := interval >> 3 // 12.5%
-	msg.InfoOnTrue(freeIDs < wrnLimit, "WARNING: Less than 12.5% IDs free!")
-	if interval <= 0 {
-		log.Fatal(w, "No ID space left:", min, max)
-	}
-	id = min + TriceID(rand.Intn(interval))
-	if len(ilu) == 0 {
-		return
-	}
-	for {
-	nextTry:
-		for k := range ilu {
-			if id == k { // id used
-				fmt.Fprintln(w, "ID", id, "used, next try...")
-				id = min + TriceID(rand.Intn(interval))
-				goto nextTry
-			}
-		}
-		return
-	}
-}
-
-// newUpwardID provides the smallest free ID inside interval [min,max].
-// The delivered id is usable as key for lut, but not added. So calling fn twice without adding to ilu gives the same value back.
-func (ilu TriceIDLookUp) newUpwardID(min, max TriceID) (id TriceID) {
-	interval := int(max - min + 1)
-	freeIDs := interval - len(ilu)
-	msg.FatalInfoOnFalse(freeIDs > 0, "no new ID possible: "+fmt.Sprint("min=", min, ", max=", max, ", used=", len(ilu)))
-	id = min
-	if len(ilu) == 0 {
-		return
-	}
-	for {
-	nextTry:
-		for k := range ilu {
-			if id == k { // id used
-				id++
-				goto nextTry
-			}
-		}
-		return
-	}
-}
-
-// newDownwardID provides the biggest free ID inside interval [min,max].
-// The delivered id is usable as key for lut, but not added. So calling fn twice without adding to ilu gives the same value back.
-func (ilu TriceIDLookUp) newDownwardID(min, max TriceID) (id TriceID) {
-	interval := int(max - min + 1)
-	freeIDs := interval - len(ilu)
-	msg.FatalInfoOnFalse(freeIDs > 0, "no new ID possible: "+fmt.Sprint("min=", min, ", max=", max, ", used=", len(ilu)))
-	id = max
-	if len(ilu) == 0 {
-		return
-	}
-	for {
-	nextTry:
-		for k := range ilu {
-			if id == k { // id used
-				id--
-				goto nextTry
-			}
-		}
-		return
+		id, ok = alloc.AllocDownward()
+	default:
+		msg.Info(fmt.Sprint("ERROR:", searchMethod, "is unknown ID search method."))
+		return 0
 	}
+	msg.FatalInfoOnFalse(ok, "no new ID possible: "+fmt.Sprint("min=", min, ", max=", max, ", used=", len(ilu)))
+	return id
 }
 
 // FromJSON converts JSON byte slice to ilu.